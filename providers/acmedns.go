@@ -0,0 +1,36 @@
+package providers
+
+import "fmt"
+
+// ACMEDNSSolver lets a provider satisfy ACME DNS-01 challenges directly,
+// independent of the normal GetDomainCorrections diffing path. This is what
+// external ACME clients (or a `dnscontrol acme` subcommand) drive against.
+type ACMEDNSSolver interface {
+	// Present creates (or updates) the TXT record that proves control of
+	// keyAuth for domain's DNS-01 challenge identified by token.
+	Present(domain, token, keyAuth string) error
+	// CleanUp removes the TXT record created by Present.
+	CleanUp(domain, token, keyAuth string) error
+}
+
+// ACMEDNSSolverInitializer is a function that can initialize a new ACME DNS
+// solver from the given credentials.
+type ACMEDNSSolverInitializer func(map[string]string) (ACMEDNSSolver, error)
+
+var acmeDNSSolverTypes = map[string]ACMEDNSSolverInitializer{}
+
+// RegisterACMEDNSSolver registers a provider type as usable for ACME DNS-01
+// challenges, so it can later be instantiated with CreateACMEDNSSolver.
+func RegisterACMEDNSSolver(providerType string, init ACMEDNSSolverInitializer) {
+	acmeDNSSolverTypes[providerType] = init
+}
+
+// CreateACMEDNSSolver instantiates the ACME DNS solver registered under
+// providerType with the given credentials.
+func CreateACMEDNSSolver(providerType string, conf map[string]string) (ACMEDNSSolver, error) {
+	init, ok := acmeDNSSolverTypes[providerType]
+	if !ok {
+		return nil, fmt.Errorf("No ACME DNS solver with name '%s' has been registered", providerType)
+	}
+	return init(conf)
+}
@@ -0,0 +1,144 @@
+package namecheap
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	nc "github.com/billputer/go-namecheap"
+)
+
+// fakeNamecheapAPI is a minimal in-memory stand-in for the real
+// namecheap.domains.dns.getHosts/setHosts endpoints, just enough to drive
+// setACMERecord's merge logic end to end.
+type fakeNamecheapAPI struct {
+	mu    sync.Mutex
+	hosts []xmlHost
+}
+
+func (f *fakeNamecheapAPI) handler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Form.Get("Command") {
+	case "namecheap.domains.dns.getHosts":
+		var sb string
+		for _, h := range f.hosts {
+			sb += fmt.Sprintf(`<host Name=%q Type=%q Address=%q MXPref=%q TTL=%q />`, h.Name, h.Type, h.Address, h.MXPref, h.TTL)
+		}
+		fmt.Fprintf(w, `<ApiResponse Status="OK"><CommandResponse><DomainDNSGetHostsResult>%s</DomainDNSGetHostsResult></CommandResponse></ApiResponse>`, sb)
+	case "namecheap.domains.dns.setHosts":
+		var newHosts []xmlHost
+		for i := 1; ; i++ {
+			idx := strconv.Itoa(i)
+			name := r.Form.Get("HostName" + idx)
+			typ := r.Form.Get("RecordType" + idx)
+			if name == "" && typ == "" {
+				break
+			}
+			newHosts = append(newHosts, xmlHost{
+				Name:    name,
+				Type:    typ,
+				Address: r.Form.Get("Address" + idx),
+				MXPref:  r.Form.Get("MXPref" + idx),
+				TTL:     r.Form.Get("TTL" + idx),
+			})
+		}
+		f.hosts = newHosts
+		fmt.Fprint(w, `<ApiResponse Status="OK"><CommandResponse></CommandResponse></ApiResponse>`)
+	default:
+		http.Error(w, "unsupported command", http.StatusBadRequest)
+	}
+}
+
+func newTestNamecheap(t *testing.T, api *fakeNamecheapAPI) *Namecheap {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(api.handler))
+	t.Cleanup(ts.Close)
+
+	n := &Namecheap{
+		ApiUser:             "user",
+		ApiKey:              "key",
+		ClientIP:            "203.0.113.5",
+		PropagationTimeout:  0,
+		PropagationInterval: 0,
+		client:              nc.NewClient("user", "key", "203.0.113.5"),
+	}
+	n.client.BaseURL = ts.URL
+	return n
+}
+
+func (f *fakeNamecheapAPI) txtNamed(name string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var values []string
+	for _, h := range f.hosts {
+		if h.Type == "TXT" && h.Name == name {
+			values = append(values, h.Address)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+// TestPresentConcurrentSANsKeepBothChallenges makes sure a wildcard + base
+// domain SAN cert request, which needs two simultaneous TXT records at the
+// same _acme-challenge name, doesn't have one Present call delete the
+// other's just-written record.
+func TestPresentConcurrentSANsKeepBothChallenges(t *testing.T) {
+	api := &fakeNamecheapAPI{}
+	n := newTestNamecheap(t, api)
+
+	var wg sync.WaitGroup
+	for _, keyAuth := range []string{"auth-for-base-domain", "auth-for-wildcard"} {
+		wg.Add(1)
+		go func(keyAuth string) {
+			defer wg.Done()
+			if err := n.Present("example.com", "token", keyAuth); err != nil {
+				t.Errorf("Present(%q) failed: %s", keyAuth, err)
+			}
+		}(keyAuth)
+	}
+	wg.Wait()
+
+	values := api.txtNamed("_acme-challenge")
+	if len(values) != 2 {
+		t.Fatalf("got %d TXT records at _acme-challenge, want 2 (one per SAN): %v", len(values), values)
+	}
+}
+
+// TestCleanUpOnlyRemovesItsOwnValue checks that CleanUp for one
+// identifier's challenge leaves a sibling identifier's still-active
+// challenge record in place.
+func TestCleanUpOnlyRemovesItsOwnValue(t *testing.T) {
+	api := &fakeNamecheapAPI{}
+	n := newTestNamecheap(t, api)
+
+	if err := n.Present("example.com", "token", "auth-for-base-domain"); err != nil {
+		t.Fatalf("Present (base) failed: %s", err)
+	}
+	if err := n.Present("example.com", "token", "auth-for-wildcard"); err != nil {
+		t.Fatalf("Present (wildcard) failed: %s", err)
+	}
+	if got := len(api.txtNamed("_acme-challenge")); got != 2 {
+		t.Fatalf("got %d TXT records before cleanup, want 2", got)
+	}
+
+	if err := n.CleanUp("example.com", "token", "auth-for-base-domain"); err != nil {
+		t.Fatalf("CleanUp (base) failed: %s", err)
+	}
+
+	values := api.txtNamed("_acme-challenge")
+	if len(values) != 1 {
+		t.Fatalf("got %d TXT records after cleaning up one, want 1: %v", len(values), values)
+	}
+}
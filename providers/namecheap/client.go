@@ -0,0 +1,236 @@
+package namecheap
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/StackExchange/dnscontrol/models"
+	"github.com/miekg/dns/dnsutil"
+)
+
+// billputer/go-namecheap talks to namecheap.domains.dns.getHosts/setHosts
+// but its DomainDNSHost type only has room for Name/Type/Address/MXPref/TTL.
+// The raw XML API also accepts/returns SRV and CAA specific fields, so the
+// hosts calls below hit the endpoint directly instead of going through that
+// library.
+
+// xmlHost is one <host> entry from a namecheap.domains.dns.getHosts response.
+type xmlHost struct {
+	Name    string `xml:"Name,attr"`
+	Type    string `xml:"Type,attr"`
+	Address string `xml:"Address,attr"`
+	MXPref  string `xml:"MXPref,attr"`
+	TTL     string `xml:"TTL,attr"`
+}
+
+// xmlHostParam is one numbered HostName/RecordType/Address/MXPref/TTL tuple
+// sent to namecheap.domains.dns.setHosts.
+type xmlHostParam struct {
+	Name    string
+	Type    string
+	Address string
+	MXPref  string
+	TTL     string
+}
+
+type xmlAPIResponse struct {
+	XMLName xml.Name `xml:"ApiResponse"`
+	Status  string   `xml:"Status,attr"`
+	Errors  struct {
+		Error []xmlAPIError `xml:"Error"`
+	} `xml:"Errors"`
+	CommandResponse struct {
+		DomainDNSGetHostsResult struct {
+			Hosts []xmlHost `xml:"host"`
+		} `xml:"DomainDNSGetHostsResult"`
+	} `xml:"CommandResponse"`
+}
+
+type xmlAPIError struct {
+	Number  string `xml:"Number,attr"`
+	Message string `xml:",chardata"`
+}
+
+// apiPost form-encodes params, adds the required auth parameters, and POSTs
+// command to the xml.response endpoint, returning the parsed response.
+func (n *Namecheap) apiPost(command string, params url.Values) (*xmlAPIResponse, error) {
+	params = cloneValues(params)
+	params.Set("ApiUser", n.ApiUser)
+	params.Set("ApiKey", n.ApiKey)
+	params.Set("UserName", n.ApiUser)
+	params.Set("ClientIp", n.ClientIP)
+	params.Set("Command", command)
+
+	resp, err := http.PostForm(n.xmlBaseURL(), params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed xmlAPIResponse
+	if err := xml.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("Namecheap: could not parse %s response: %s", command, err)
+	}
+	if parsed.Status != "OK" {
+		if len(parsed.Errors.Error) > 0 {
+			e := parsed.Errors.Error[0]
+			if e.Number == "500000" {
+				return nil, fmt.Errorf("Error 500000: Too many requests")
+			}
+			return nil, fmt.Errorf("Namecheap API error %s: %s", e.Number, e.Message)
+		}
+		return nil, fmt.Errorf("Namecheap: %s did not return Status=OK", command)
+	}
+	return &parsed, nil
+}
+
+// xmlBaseURL mirrors n.client.BaseURL (production, sandbox, or explicit
+// override), since the two clients need to stay pointed at the same tenant.
+func (n *Namecheap) xmlBaseURL() string {
+	if n.client.BaseURL != "" {
+		return n.client.BaseURL
+	}
+	return "https://api.namecheap.com/xml.response"
+}
+
+// getHostsXML fetches the current host list for sld.tld, including the SRV
+// and CAA fields that billputer/go-namecheap's DomainDNSGetHostsResult drops.
+func (n *Namecheap) getHostsXML(sld, tld string) ([]xmlHost, error) {
+	params := url.Values{"SLD": {sld}, "TLD": {tld}}
+	var resp *xmlAPIResponse
+	var err error
+	n.doWithRetry(func() error {
+		resp, err = n.apiPost("namecheap.domains.dns.getHosts", params)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.CommandResponse.DomainDNSGetHostsResult.Hosts, nil
+}
+
+// setHostsXML writes the full host list for sld.tld, numbering each record's
+// HostName/RecordType/Address/MXPref/TTL as Namecheap's setHosts expects.
+func (n *Namecheap) setHostsXML(sld, tld string, recs []xmlHostParam) error {
+	params := url.Values{"SLD": {sld}, "TLD": {tld}}
+	for i, r := range recs {
+		idx := strconv.Itoa(i + 1)
+		params.Set("HostName"+idx, r.Name)
+		params.Set("RecordType"+idx, r.Type)
+		params.Set("Address"+idx, r.Address)
+		if r.MXPref != "" {
+			params.Set("MXPref"+idx, r.MXPref)
+		}
+		if r.TTL != "" {
+			params.Set("TTL"+idx, r.TTL)
+		}
+	}
+	var err error
+	n.doWithRetry(func() error {
+		_, err = n.apiPost("namecheap.domains.dns.setHosts", params)
+		return err
+	})
+	return err
+}
+
+func cloneValues(v url.Values) url.Values {
+	out := make(url.Values, len(v))
+	for k, vs := range v {
+		out[k] = append([]string(nil), vs...)
+	}
+	return out
+}
+
+// recordToXMLHostParam converts rec into the wire format setHostsXML sends.
+// SRV sends its priority through MXPref and packs weight/port/target
+// space-separated into Address; CAA packs flag/tag/value into Address.
+func recordToXMLHostParam(rec *models.RecordConfig, origin string) xmlHostParam {
+	p := xmlHostParam{
+		Name: dnsutil.TrimDomainName(rec.NameFQDN, origin),
+		Type: rec.Type,
+		TTL:  strconv.Itoa(int(rec.TTL)),
+	}
+	switch rec.Type {
+	case "MX":
+		p.Address = rec.Target
+		p.MXPref = strconv.Itoa(int(rec.MxPreference))
+	case "SRV":
+		p.Address = fmt.Sprintf("%d %d %s", rec.SrvWeight, rec.SrvPort, rec.Target)
+		p.MXPref = strconv.Itoa(int(rec.SrvPriority))
+	case "CAA":
+		p.Address = fmt.Sprintf("%d %s %s", rec.CaaFlag, rec.CaaTag, rec.Target)
+	default:
+		p.Address = rec.Target
+	}
+	return p
+}
+
+// xmlHostToRecord is the inverse of recordToXMLHostParam, for turning a
+// getHosts response back into a models.RecordConfig.
+func xmlHostToRecord(h xmlHost, origin string) (*models.RecordConfig, error) {
+	ttl, err := strconv.Atoi(h.TTL)
+	if err != nil {
+		return nil, fmt.Errorf("Namecheap: invalid TTL %q for %s record %q", h.TTL, h.Type, h.Name)
+	}
+
+	rec := &models.RecordConfig{
+		NameFQDN: dnsutil.AddOrigin(h.Name, origin),
+		Type:     h.Type,
+		TTL:      uint32(ttl),
+		Original: h,
+	}
+
+	switch h.Type {
+	case "SRV":
+		var weight, port int
+		var target string
+		if _, err := fmt.Sscanf(h.Address, "%d %d %s", &weight, &port, &target); err != nil {
+			return nil, fmt.Errorf("Namecheap: could not parse SRV address %q for %q", h.Address, h.Name)
+		}
+		if h.MXPref != "" {
+			priority, err := strconv.Atoi(h.MXPref)
+			if err != nil {
+				return nil, fmt.Errorf("Namecheap: invalid SRV priority %q for %q", h.MXPref, h.Name)
+			}
+			rec.SrvPriority = uint16(priority)
+		}
+		rec.SrvWeight = uint16(weight)
+		rec.SrvPort = uint16(port)
+		rec.Target = target
+	case "CAA":
+		// The value (e.g. a Let's Encrypt accounturi/validationmethods CAA
+		// parameter list) may itself contain spaces, so only the flag and
+		// tag are fixed tokens; everything after them is the value verbatim.
+		fields := strings.SplitN(h.Address, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Namecheap: could not parse CAA address %q for %q", h.Address, h.Name)
+		}
+		flag, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Namecheap: invalid CAA flag %q for %q", fields[0], h.Name)
+		}
+		rec.CaaFlag = uint8(flag)
+		rec.CaaTag = fields[1]
+		rec.Target = fields[2]
+	default:
+		rec.Target = h.Address
+		if h.MXPref != "" {
+			pref, err := strconv.Atoi(h.MXPref)
+			if err != nil {
+				return nil, fmt.Errorf("Namecheap: invalid MXPref %q for %q", h.MXPref, h.Name)
+			}
+			rec.MxPreference = uint16(pref)
+		}
+	}
+
+	return rec, nil
+}
@@ -0,0 +1,99 @@
+package namecheap
+
+import (
+	"testing"
+
+	"github.com/StackExchange/dnscontrol/models"
+)
+
+func TestSRVRoundTrip(t *testing.T) {
+	rec := &models.RecordConfig{
+		NameFQDN:    "_sip._tcp.example.com.",
+		Type:        "SRV",
+		Target:      "sipserver.example.com.",
+		TTL:         300,
+		SrvPriority: 10,
+		SrvWeight:   20,
+		SrvPort:     5060,
+	}
+
+	param := recordToXMLHostParam(rec, "example.com")
+	host := xmlHost{Name: param.Name, Type: param.Type, Address: param.Address, MXPref: param.MXPref, TTL: param.TTL}
+
+	got, err := xmlHostToRecord(host, "example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got.SrvPriority != rec.SrvPriority || got.SrvWeight != rec.SrvWeight || got.SrvPort != rec.SrvPort {
+		t.Errorf("SRV fields did not round-trip: got %+v, want priority=%d weight=%d port=%d",
+			got, rec.SrvPriority, rec.SrvWeight, rec.SrvPort)
+	}
+	if got.Target != rec.Target {
+		t.Errorf("got Target %q, want %q", got.Target, rec.Target)
+	}
+}
+
+func TestCAARoundTrip(t *testing.T) {
+	rec := &models.RecordConfig{
+		NameFQDN: "example.com.",
+		Type:     "CAA",
+		Target:   "letsencrypt.org",
+		TTL:      300,
+		CaaFlag:  0,
+		CaaTag:   "issue",
+	}
+
+	param := recordToXMLHostParam(rec, "example.com")
+	host := xmlHost{Name: param.Name, Type: param.Type, Address: param.Address, MXPref: param.MXPref, TTL: param.TTL}
+
+	got, err := xmlHostToRecord(host, "example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got.CaaFlag != rec.CaaFlag || got.CaaTag != rec.CaaTag || got.Target != rec.Target {
+		t.Errorf("CAA fields did not round-trip: got %+v, want %+v", got, rec)
+	}
+}
+
+func TestCAARoundTripValueWithSpaces(t *testing.T) {
+	rec := &models.RecordConfig{
+		NameFQDN: "example.com.",
+		Type:     "CAA",
+		Target:   `letsencrypt.org; accounturi=https://acme-v02.api.letsencrypt.org/acme/acct/123; validationmethods=dns-01`,
+		TTL:      300,
+		CaaFlag:  0,
+		CaaTag:   "issue",
+	}
+
+	param := recordToXMLHostParam(rec, "example.com")
+	host := xmlHost{Name: param.Name, Type: param.Type, Address: param.Address, MXPref: param.MXPref, TTL: param.TTL}
+
+	got, err := xmlHostToRecord(host, "example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got.Target != rec.Target {
+		t.Errorf("CAA value with spaces was truncated: got %q, want %q", got.Target, rec.Target)
+	}
+}
+
+func TestMXRoundTrip(t *testing.T) {
+	rec := &models.RecordConfig{
+		NameFQDN:     "example.com.",
+		Type:         "MX",
+		Target:       "mail.example.com.",
+		TTL:          300,
+		MxPreference: 10,
+	}
+
+	param := recordToXMLHostParam(rec, "example.com")
+	host := xmlHost{Name: param.Name, Type: param.Type, Address: param.Address, MXPref: param.MXPref, TTL: param.TTL}
+
+	got, err := xmlHostToRecord(host, "example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got.MxPreference != rec.MxPreference || got.Target != rec.Target {
+		t.Errorf("MX fields did not round-trip: got %+v, want %+v", got, rec)
+	}
+}
@@ -1,11 +1,18 @@
 package namecheap
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/publicsuffix"
@@ -14,24 +21,62 @@ import (
 	"github.com/StackExchange/dnscontrol/providers"
 	"github.com/StackExchange/dnscontrol/providers/diff"
 	nc "github.com/billputer/go-namecheap"
+	"github.com/miekg/dns"
 	"github.com/miekg/dns/dnsutil"
 )
 
+// getIPURL is Namecheap's own IP echo service. It returns the caller's
+// outbound IP as plain text, which is exactly what needs to be whitelisted
+// (and sent as ClientIp) for their API.
+var getIPURL = "https://dynamicdns.park-your-domain.com/getip"
+
+// sandboxBaseURL is used instead of the production API when creds specify
+// "sandbox": "true", so a dnscontrol push can be dry-run against Namecheap's
+// test tenants without touching real domains.
+const sandboxBaseURL = "https://api.sandbox.namecheap.com/xml.response"
+
 var NamecheapDefaultNs = []string{"dns1.registrar-servers.com", "dns2.registrar-servers.com"}
 
 type Namecheap struct {
-	ApiKey  string
-	ApiUser string
-	client  *nc.Client
+	ApiKey   string
+	ApiUser  string
+	ClientIP string
+	Sandbox  bool
+	client   *nc.Client
+
+	// PropagationTimeout bounds how long generateRecords will poll the
+	// authoritative nameservers for the just-written records before giving
+	// up. PropagationInterval is the delay between polls. PropagationStrict,
+	// if set, turns a timeout into a hard error instead of a logged warning.
+	PropagationTimeout  time.Duration
+	PropagationInterval time.Duration
+	PropagationStrict   bool
+
+	// domainLocks guards against concurrent Present/CleanUp calls clobbering
+	// each other's writes to the same domain's (whole-zone) host list.
+	domainLocks sync.Map // domain (sld.tld) -> *sync.Mutex
 }
 
+// namecheapMeta is the shape of the provider metadata block in creds.json,
+// used to tune the post-write propagation check.
+type namecheapMeta struct {
+	PropagationTimeout  string `json:"propagation_timeout"`
+	PropagationInterval string `json:"propagation_interval"`
+	PropagationStrict   bool   `json:"propagation_strict"`
+}
+
+const (
+	defaultPropagationTimeout  = 10 * time.Minute
+	defaultPropagationInterval = 15 * time.Second
+)
+
 var docNotes = providers.DocumentationNotes{
 	providers.DocCreateDomains:       providers.Cannot("Requires domain registered through their service"),
 	providers.DocOfficiallySupported: providers.Cannot(),
 	providers.DocDualHost:            providers.Cannot("Doesn't allow control of apex NS records"),
-	providers.CanUseAlias:            providers.Cannot(),
-	providers.CanUseCAA:              providers.Cannot(),
-	providers.CanUseSRV:              providers.Cannot("The namecheap web console allows you to make SRV records, but their api does not let you read or set them"),
+	providers.CanUseAlias:            providers.Cannot("Namecheap's API has no ALIAS/ANAME record type"),
+	providers.CanUseCAA:              providers.Can(),
+	providers.CanUseSRV:              providers.Can(),
 	providers.CanUsePTR:              providers.Cannot(),
 	providers.CanUseTLSA:             providers.Cannot(),
 }
@@ -42,6 +87,7 @@ func init() {
 	providers.RegisterCustomRecordType("URL", "NAMECHEAP", "")
 	providers.RegisterCustomRecordType("URL301", "NAMECHEAP", "")
 	providers.RegisterCustomRecordType("FRAME", "NAMECHEAP", "")
+	providers.RegisterACMEDNSSolver("NAMECHEAP", newACMESolver)
 }
 
 func newDsp(conf map[string]string, metadata json.RawMessage) (providers.DNSServiceProvider, error) {
@@ -52,21 +98,94 @@ func newReg(conf map[string]string) (providers.Registrar, error) {
 	return newProvider(conf, nil)
 }
 
+func newACMESolver(conf map[string]string) (providers.ACMEDNSSolver, error) {
+	return newProvider(conf, nil)
+}
+
 func newProvider(m map[string]string, metadata json.RawMessage) (*Namecheap, error) {
 	api := &Namecheap{}
 	api.ApiUser, api.ApiKey = m["apiuser"], m["apikey"]
 	if api.ApiKey == "" || api.ApiUser == "" {
 		return nil, fmt.Errorf("Namecheap apikey and apiuser must be provided.")
 	}
-	api.client = nc.NewClient(api.ApiUser, api.ApiKey, api.ApiUser)
-	// if BaseURL is specified in creds, use that url
-	BaseURL, ok := m["BaseURL"]
-	if ok {
+
+	api.ClientIP = m["clientip"]
+	if api.ClientIP == "" {
+		ip, err := detectClientIP()
+		if err != nil {
+			return nil, fmt.Errorf("Namecheap: could not auto-detect client IP: %s", err)
+		}
+		api.ClientIP = ip
+	}
+	if net.ParseIP(api.ClientIP) == nil {
+		return nil, fmt.Errorf("Namecheap: client IP %q is not valid", api.ClientIP)
+	}
+	log.Printf("DEBUG: Namecheap client IP is %s. Make sure it is whitelisted in your Namecheap account.", api.ClientIP)
+
+	api.client = nc.NewClient(api.ApiUser, api.ApiKey, api.ClientIP)
+
+	api.Sandbox = m["sandbox"] == "true"
+	if api.Sandbox {
+		api.client.BaseURL = sandboxBaseURL
+	}
+	// if BaseURL is specified in creds, it takes precedence over sandbox
+	if BaseURL, ok := m["BaseURL"]; ok {
 		api.client.BaseURL = BaseURL
 	}
+
+	api.PropagationTimeout = defaultPropagationTimeout
+	api.PropagationInterval = defaultPropagationInterval
+	if len(metadata) > 0 {
+		var meta namecheapMeta
+		if err := json.Unmarshal(metadata, &meta); err != nil {
+			return nil, fmt.Errorf("Namecheap: could not parse provider metadata: %s", err)
+		}
+		if meta.PropagationTimeout != "" {
+			d, err := time.ParseDuration(meta.PropagationTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("Namecheap: invalid propagation_timeout %q: %s", meta.PropagationTimeout, err)
+			}
+			api.PropagationTimeout = d
+		}
+		if meta.PropagationInterval != "" {
+			d, err := time.ParseDuration(meta.PropagationInterval)
+			if err != nil {
+				return nil, fmt.Errorf("Namecheap: invalid propagation_interval %q: %s", meta.PropagationInterval, err)
+			}
+			api.PropagationInterval = d
+		}
+		api.PropagationStrict = meta.PropagationStrict
+	}
+
 	return api, nil
 }
 
+// detectClientIPTimeout bounds how long detectClientIP will wait, since it
+// runs synchronously in newProvider on every invocation that touches this
+// provider and a stalled IP-echo service shouldn't hang the whole run.
+const detectClientIPTimeout = 10 * time.Second
+
+// detectClientIP asks Namecheap's IP echo service for our outbound IP, since
+// that's what Namecheap needs whitelisted and what must be sent as ClientIp
+// on every API call.
+func detectClientIP() (string, error) {
+	client := http.Client{Timeout: detectClientIPTimeout}
+	resp, err := client.Get(getIPURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	ip := strings.TrimSpace(string(body))
+	if ip == "" {
+		return "", fmt.Errorf("%s returned an empty response", getIPURL)
+	}
+	return ip, nil
+}
+
 func splitDomain(domain string) (sld string, tld string) {
 	tld, _ = publicsuffix.PublicSuffix(domain)
 	d, _ := publicsuffix.EffectiveTLDPlusOne(domain)
@@ -80,10 +199,16 @@ func splitDomain(domain string) (sld string, tld string) {
 //     If you can limit the requests within these it should be fine."
 // this helper performs some api action, checks for rate limited response, and if so, enters a retry loop until it resolves
 // if you are consistently hitting this, you may have success asking their support to increase your account's limits.
-func doWithRetry(f func() error) {
-	// sleep 5 seconds at a time, up to 23 times (1 minute, 15 seconds)
-	const maxRetries = 23
-	const sleepTime = 5 * time.Second
+// Sandbox tenants have different (and generally looser) limits, so a sandbox
+// provider uses a shorter schedule.
+func (n *Namecheap) doWithRetry(f func() error) {
+	maxRetries := 23
+	sleepTime := 5 * time.Second
+	if n.Sandbox {
+		// up to 10 attempts, sleeping 2 seconds between them (18 seconds)
+		maxRetries = 10
+		sleepTime = 2 * time.Second
+	}
 	var currentRetry int
 	for {
 		err := f()
@@ -106,12 +231,7 @@ func doWithRetry(f func() error) {
 func (n *Namecheap) GetDomainCorrections(dc *models.DomainConfig) ([]*models.Correction, error) {
 	dc.Punycode()
 	sld, tld := splitDomain(dc.Name)
-	var records *nc.DomainDNSGetHostsResult
-	var err error
-	doWithRetry(func() error {
-		records, err = n.client.DomainsDNSGetHosts(sld, tld)
-		return err
-	})
+	hosts, err := n.getHostsXML(sld, tld)
 	if err != nil {
 		return nil, err
 	}
@@ -132,25 +252,23 @@ func (n *Namecheap) GetDomainCorrections(dc *models.DomainConfig) ([]*models.Cor
 	// namecheap has this really annoying feature where they add some parking records if you have no records.
 	// This causes a few problems for our purposes, specifically the integration tests.
 	// lets detect that one case and pretend it is a no-op.
-	if len(dc.Records) == 0 && len(records.Hosts) == 2 {
-		if records.Hosts[0].Type == "CNAME" &&
-			strings.Contains(records.Hosts[0].Address, "parkingpage") &&
-			records.Hosts[1].Type == "URL" {
+	// Sandbox tenants don't get parking records, so this heuristic would
+	// never fire there anyway, but skip it explicitly to avoid surprises.
+	if !n.Sandbox && len(dc.Records) == 0 && len(hosts) == 2 {
+		if hosts[0].Type == "CNAME" &&
+			strings.Contains(hosts[0].Address, "parkingpage") &&
+			hosts[1].Type == "URL" {
 			return nil, nil
 		}
 	}
 
-	for _, r := range records.Hosts {
-		if r.Type == "SOA" {
+	for _, h := range hosts {
+		if h.Type == "SOA" {
 			continue
 		}
-		rec := &models.RecordConfig{
-			NameFQDN:     dnsutil.AddOrigin(r.Name, dc.Name),
-			Type:         r.Type,
-			Target:       r.Address,
-			TTL:          uint32(r.TTL),
-			MxPreference: uint16(r.MXPref),
-			Original:     r,
+		rec, err := xmlHostToRecord(h, dc.Name)
+		if err != nil {
+			return nil, err
 		}
 		actual = append(actual, rec)
 	}
@@ -195,29 +313,149 @@ func (n *Namecheap) GetDomainCorrections(dc *models.DomainConfig) ([]*models.Cor
 
 func (n *Namecheap) generateRecords(dc *models.DomainConfig) error {
 
-	var recs []nc.DomainDNSHost
-
-	id := 1
+	var recs []xmlHostParam
 	for _, r := range dc.Records {
-		name := dnsutil.TrimDomainName(r.NameFQDN, dc.Name)
-		rec := nc.DomainDNSHost{
-			ID:      id,
-			Name:    name,
-			Type:    r.Type,
-			Address: r.Target,
-			MXPref:  int(r.MxPreference),
-			TTL:     int(r.TTL),
-		}
-		recs = append(recs, rec)
-		id++
+		recs = append(recs, recordToXMLHostParam(r, dc.Name))
 	}
+
 	sld, tld := splitDomain(dc.Name)
-	var err error
-	doWithRetry(func() error {
-		_, err = n.client.DomainDNSSetHosts(sld, tld, recs)
+	if err := n.setHostsXML(sld, tld, recs); err != nil {
 		return err
-	})
-	return err
+	}
+
+	return n.verifyPropagation(dc)
+}
+
+// maxPropagationSample caps how many records verifyPropagation will check
+// directly; beyond this it falls back to checking one A and one TXT record,
+// which is enough to catch the ACME/TXT case this was built for without
+// hammering the authoritative nameservers on every push.
+const maxPropagationSample = 5
+
+// verifyPropagation polls dc's authoritative nameservers directly until a
+// representative sample of dc.Records resolves with the expected Target and
+// TTL, or PropagationTimeout elapses. A successful DomainDNSSetHosts call
+// does not mean the new records are live yet, and ACME/TXT workflows need to
+// know the record is actually visible before the next step runs.
+func (n *Namecheap) verifyPropagation(dc *models.DomainConfig) error {
+	sample := propagationSample(dc.Records)
+	if len(sample) == 0 {
+		return nil
+	}
+
+	nameservers, err := n.GetNameservers(dc.Name)
+	if err != nil {
+		return err
+	}
+	var servers []string
+	for _, ns := range nameservers {
+		servers = append(servers, ns.Name)
+	}
+
+	deadline := time.Now().Add(n.PropagationTimeout)
+	for {
+		allLive := true
+		for _, rec := range sample {
+			if !recordIsLive(rec, servers) {
+				allLive = false
+				break
+			}
+		}
+		if allLive {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			err := fmt.Errorf("Namecheap: timed out after %s waiting for %d record(s) to propagate to %v (partial propagation)", n.PropagationTimeout, len(sample), servers)
+			if n.PropagationStrict {
+				return err
+			}
+			log.Printf("WARNING: %s", err)
+			return nil
+		}
+		time.Sleep(n.PropagationInterval)
+	}
+}
+
+// propagationSample picks a representative subset of recs to verify: all of
+// them if there are few enough, otherwise one A and one TXT record.
+func propagationSample(recs []*models.RecordConfig) []*models.RecordConfig {
+	if len(recs) <= maxPropagationSample {
+		return recs
+	}
+	var sample []*models.RecordConfig
+	var haveA, haveTXT bool
+	for _, r := range recs {
+		if r.Type == "A" && !haveA {
+			sample = append(sample, r)
+			haveA = true
+		}
+		if r.Type == "TXT" && !haveTXT {
+			sample = append(sample, r)
+			haveTXT = true
+		}
+		if haveA && haveTXT {
+			break
+		}
+	}
+	return sample
+}
+
+// recordIsLive queries each of servers directly for rec and returns true if
+// any of them answers with rec's Target and TTL.
+func recordIsLive(rec *models.RecordConfig, servers []string) bool {
+	qtype, ok := dns.StringToType[rec.Type]
+	if !ok {
+		// We don't know how to verify this record type directly; assume it's fine.
+		return true
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(rec.NameFQDN), qtype)
+	c := new(dns.Client)
+	c.Timeout = 5 * time.Second
+
+	for _, server := range servers {
+		in, _, err := c.Exchange(m, net.JoinHostPort(server, "53"))
+		if err != nil {
+			continue
+		}
+		for _, ans := range in.Answer {
+			if answerMatches(ans, rec) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// answerMatches reports whether ans is the live version of rec.
+func answerMatches(ans dns.RR, rec *models.RecordConfig) bool {
+	if ans.Header().Ttl != rec.TTL {
+		return false
+	}
+	switch a := ans.(type) {
+	case *dns.A:
+		return a.A.String() == rec.Target
+	case *dns.AAAA:
+		return a.AAAA.String() == rec.Target
+	case *dns.TXT:
+		return strings.Join(a.Txt, "") == rec.Target
+	case *dns.CNAME:
+		return a.Target == dns.Fqdn(rec.Target)
+	case *dns.MX:
+		return a.Mx == dns.Fqdn(rec.Target) && a.Preference == rec.MxPreference
+	case *dns.SRV:
+		return a.Target == dns.Fqdn(rec.Target) &&
+			a.Priority == rec.SrvPriority &&
+			a.Weight == rec.SrvWeight &&
+			a.Port == rec.SrvPort
+	case *dns.CAA:
+		return a.Value == rec.Target &&
+			a.Tag == rec.CaaTag &&
+			a.Flag == rec.CaaFlag
+	default:
+		return false
+	}
 }
 
 func (n *Namecheap) GetNameservers(domainName string) ([]*models.Nameserver, error) {
@@ -230,7 +468,7 @@ func (n *Namecheap) GetNameservers(domainName string) ([]*models.Nameserver, err
 func (n *Namecheap) GetRegistrarCorrections(dc *models.DomainConfig) ([]*models.Correction, error) {
 	var info *nc.DomainInfo
 	var err error
-	doWithRetry(func() error {
+	n.doWithRetry(func() error {
 		info, err = n.client.DomainGetInfo(dc.Name)
 		return err
 	})
@@ -252,7 +490,7 @@ func (n *Namecheap) GetRegistrarCorrections(dc *models.DomainConfig) ([]*models.
 			{
 				Msg: fmt.Sprintf("Change Nameservers from '%s' to '%s'", found, desired),
 				F: func() (err error) {
-					doWithRetry(func() error {
+					n.doWithRetry(func() error {
 						_, err = n.client.DomainDNSSetCustom(sld, tld, desired)
 						return err
 					})
@@ -261,4 +499,82 @@ func (n *Namecheap) GetRegistrarCorrections(dc *models.DomainConfig) ([]*models.
 		}, nil
 	}
 	return nil, nil
-}
\ No newline at end of file
+}
+// acmeTXTTTL is the TTL used for the _acme-challenge TXT record written by
+// Present. It's short because the record is only needed for the duration of
+// the challenge.
+const acmeTXTTTL = 120
+
+// Present implements providers.ACMEDNSSolver. It computes the
+// _acme-challenge TXT record for domain's DNS-01 challenge and merges it
+// into the zone's existing host list.
+func (n *Namecheap) Present(domain, token, keyAuth string) error {
+	return n.setACMERecord(domain, keyAuth, true)
+}
+
+// CleanUp implements providers.ACMEDNSSolver. It removes the TXT record
+// created by Present.
+func (n *Namecheap) CleanUp(domain, token, keyAuth string) error {
+	return n.setACMERecord(domain, keyAuth, false)
+}
+
+// setACMERecord adds or removes the _acme-challenge TXT record for domain.
+// Namecheap's set-hosts call replaces the whole zone, so this locks per
+// apex domain to keep concurrent wildcard+base-domain challenges from
+// clobbering each other.
+func (n *Namecheap) setACMERecord(domain, keyAuth string, present bool) error {
+	sld, tld := splitDomain(domain)
+	apex := sld + "." + tld
+	relName := dnsutil.TrimDomainName("_acme-challenge."+domain, apex)
+	sum := sha256.Sum256([]byte(keyAuth))
+	value := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	mu := n.lockFor(apex)
+	mu.Lock()
+	defer mu.Unlock()
+
+	hosts, err := n.getHostsXML(sld, tld)
+	if err != nil {
+		return fmt.Errorf("Namecheap: could not read hosts for ACME challenge on %s: %s", domain, err)
+	}
+
+	var recs []xmlHostParam
+	for _, h := range hosts {
+		if h.Type == "SOA" {
+			continue
+		}
+		if h.Type == "TXT" && h.Name == relName && h.Address == value {
+			// drop only this call's own challenge value; a SAN cert for
+			// both "example.com" and "*.example.com" needs two TXT records
+			// at this same name simultaneously, one per key authorization,
+			// so a sibling Present's record must be left alone.
+			continue
+		}
+		recs = append(recs, xmlHostParam{Name: h.Name, Type: h.Type, Address: h.Address, MXPref: h.MXPref, TTL: h.TTL})
+	}
+	if present {
+		recs = append(recs, xmlHostParam{Name: relName, Type: "TXT", Address: value, TTL: strconv.Itoa(acmeTXTTTL)})
+	}
+
+	if err := n.setHostsXML(sld, tld, recs); err != nil {
+		return fmt.Errorf("Namecheap: could not write ACME challenge record for %s: %s", domain, err)
+	}
+	if !present {
+		return nil
+	}
+
+	rec := &models.RecordConfig{
+		NameFQDN: dnsutil.AddOrigin(relName, apex),
+		Type:     "TXT",
+		Target:   value,
+		TTL:      acmeTXTTTL,
+	}
+	return n.verifyPropagation(&models.DomainConfig{Name: apex, Records: []*models.RecordConfig{rec}})
+}
+
+// lockFor returns the mutex guarding writes to domain's host list, creating
+// one on first use.
+func (n *Namecheap) lockFor(domain string) *sync.Mutex {
+	v, _ := n.domainLocks.LoadOrStore(domain, &sync.Mutex{})
+	return v.(*sync.Mutex)
+}
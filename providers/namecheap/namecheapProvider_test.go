@@ -0,0 +1,40 @@
+package namecheap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDetectClientIP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("  203.0.113.5\n"))
+	}))
+	defer ts.Close()
+
+	old := getIPURL
+	getIPURL = ts.URL
+	defer func() { getIPURL = old }()
+
+	ip, err := detectClientIP()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ip != "203.0.113.5" {
+		t.Errorf("got %q, want %q", ip, "203.0.113.5")
+	}
+}
+
+func TestDetectClientIPEmptyResponse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	old := getIPURL
+	getIPURL = ts.URL
+	defer func() { getIPURL = old }()
+
+	if _, err := detectClientIP(); err == nil {
+		t.Fatal("expected an error for an empty response, got nil")
+	}
+}
+
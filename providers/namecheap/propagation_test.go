@@ -0,0 +1,139 @@
+package namecheap
+
+import (
+	"net"
+	"testing"
+
+	"github.com/StackExchange/dnscontrol/models"
+	"github.com/miekg/dns"
+)
+
+func TestPropagationSampleUnderThreshold(t *testing.T) {
+	recs := []*models.RecordConfig{
+		{Type: "A", NameFQDN: "a.example.com."},
+		{Type: "TXT", NameFQDN: "b.example.com."},
+	}
+	sample := propagationSample(recs)
+	if len(sample) != len(recs) {
+		t.Fatalf("got %d records, want all %d", len(sample), len(recs))
+	}
+}
+
+func TestPropagationSampleOverThreshold(t *testing.T) {
+	var recs []*models.RecordConfig
+	for i := 0; i < maxPropagationSample+5; i++ {
+		recs = append(recs, &models.RecordConfig{Type: "CNAME", NameFQDN: "c.example.com."})
+	}
+	recs = append(recs,
+		&models.RecordConfig{Type: "A", NameFQDN: "a.example.com."},
+		&models.RecordConfig{Type: "TXT", NameFQDN: "t.example.com."},
+	)
+
+	sample := propagationSample(recs)
+	if len(sample) != 2 {
+		t.Fatalf("got %d records, want 2 (one A, one TXT)", len(sample))
+	}
+	var haveA, haveTXT bool
+	for _, r := range sample {
+		haveA = haveA || r.Type == "A"
+		haveTXT = haveTXT || r.Type == "TXT"
+	}
+	if !haveA || !haveTXT {
+		t.Errorf("sample %+v missing an A or TXT record", sample)
+	}
+}
+
+func TestAnswerMatches(t *testing.T) {
+	rec := &models.RecordConfig{Type: "A", Target: "203.0.113.5", TTL: 300}
+	ans := &dns.A{
+		Hdr: dns.RR_Header{Ttl: 300},
+		A:   net.ParseIP("203.0.113.5"),
+	}
+	if !answerMatches(ans, rec) {
+		t.Error("expected matching A record to match")
+	}
+
+	wrongTTL := &dns.A{Hdr: dns.RR_Header{Ttl: 60}, A: net.ParseIP("203.0.113.5")}
+	if answerMatches(wrongTTL, rec) {
+		t.Error("expected mismatched TTL to not match")
+	}
+
+	txtRec := &models.RecordConfig{Type: "TXT", Target: "hello world", TTL: 120}
+	txtAns := &dns.TXT{Hdr: dns.RR_Header{Ttl: 120}, Txt: []string{"hello world"}}
+	if !answerMatches(txtAns, txtRec) {
+		t.Error("expected matching TXT record to match")
+	}
+}
+
+func TestAnswerMatchesSRV(t *testing.T) {
+	rec := &models.RecordConfig{
+		Type:        "SRV",
+		Target:      "sipserver.example.com.",
+		TTL:         300,
+		SrvPriority: 10,
+		SrvWeight:   20,
+		SrvPort:     5060,
+	}
+	ans := &dns.SRV{
+		Hdr:      dns.RR_Header{Ttl: 300},
+		Priority: 10,
+		Weight:   20,
+		Port:     5060,
+		Target:   "sipserver.example.com.",
+	}
+	if !answerMatches(ans, rec) {
+		t.Error("expected matching SRV record to match")
+	}
+
+	wrongPort := &dns.SRV{Hdr: dns.RR_Header{Ttl: 300}, Priority: 10, Weight: 20, Port: 5061, Target: "sipserver.example.com."}
+	if answerMatches(wrongPort, rec) {
+		t.Error("expected mismatched SRV port to not match")
+	}
+}
+
+func TestAnswerMatchesCAA(t *testing.T) {
+	rec := &models.RecordConfig{
+		Type:    "CAA",
+		Target:  "letsencrypt.org",
+		TTL:     300,
+		CaaFlag: 0,
+		CaaTag:  "issue",
+	}
+	ans := &dns.CAA{
+		Hdr:   dns.RR_Header{Ttl: 300},
+		Flag:  0,
+		Tag:   "issue",
+		Value: "letsencrypt.org",
+	}
+	if !answerMatches(ans, rec) {
+		t.Error("expected matching CAA record to match")
+	}
+
+	wrongTag := &dns.CAA{Hdr: dns.RR_Header{Ttl: 300}, Flag: 0, Tag: "issuewild", Value: "letsencrypt.org"}
+	if answerMatches(wrongTag, rec) {
+		t.Error("expected mismatched CAA tag to not match")
+	}
+}
+
+// TestPropagationSampleSmallSRVCAAZone covers the scenario from the review:
+// a zone with <= maxPropagationSample records that includes SRV/CAA records
+// must still be verifiable by answerMatches, not just the A/TXT cases.
+func TestPropagationSampleSmallSRVCAAZone(t *testing.T) {
+	recs := []*models.RecordConfig{
+		{Type: "SRV", NameFQDN: "_sip._tcp.example.com.", Target: "sipserver.example.com.", TTL: 300, SrvPriority: 10, SrvWeight: 20, SrvPort: 5060},
+		{Type: "CAA", NameFQDN: "example.com.", Target: "letsencrypt.org", TTL: 300, CaaTag: "issue"},
+	}
+	sample := propagationSample(recs)
+	if len(sample) != len(recs) {
+		t.Fatalf("got %d records, want all %d", len(sample), len(recs))
+	}
+
+	srvAns := &dns.SRV{Hdr: dns.RR_Header{Ttl: 300}, Priority: 10, Weight: 20, Port: 5060, Target: "sipserver.example.com."}
+	if !answerMatches(srvAns, sample[0]) {
+		t.Error("expected SRV record in a small zone to be verifiable")
+	}
+	caaAns := &dns.CAA{Hdr: dns.RR_Header{Ttl: 300}, Tag: "issue", Value: "letsencrypt.org"}
+	if !answerMatches(caaAns, sample[1]) {
+		t.Error("expected CAA record in a small zone to be verifiable")
+	}
+}